@@ -1,9 +1,15 @@
 package middlewares
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,6 +20,36 @@ type writingMessage struct {
 	data        []byte
 }
 
+// ErrSendQueueFull is returned by Send when the bounded send queue is
+// saturated, instead of blocking the caller until a slot frees up.
+var ErrSendQueueFull = errors.New("middlewares: websocket send queue is full")
+
+// defaultInitialBackoff and defaultMaxBackoff are used by ListenWithReconnect
+// when the caller leaves the corresponding fields unset.
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// defaultWriteQueueSize and defaultWriteWait are used by Send/writePump when
+// the caller leaves WriteQueueSize/WriteWait unset.
+const (
+	defaultWriteQueueSize = 256
+	defaultWriteWait      = 10 * time.Second
+)
+
+/*
+Metrics - a snapshot of the send pipeline's health, reported through
+OnMetrics after every queued frame is written and whenever Send drops a
+payload because the queue is full, so operators can catch a queue that is filling
+up faster than the network can drain it before the process OOMs.
+*/
+type Metrics struct {
+	QueueDepth      int
+	DroppedMessages uint64
+	WriteLatency    time.Duration
+}
+
 /*
 WebsocketClient - client that listens for events and sends actions to Websocket server
 */
@@ -25,6 +61,82 @@ type WebsocketClient struct {
 	writeChan    chan writingMessage
 	writeErrChan chan error
 	initData     sync.Once
+
+	// InitialBackoff is the delay before the first reconnect attempt made by
+	// ListenWithReconnect. Defaults to 1s when zero.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff delay between reconnect
+	// attempts. Defaults to 30s when zero.
+	MaxBackoff time.Duration
+	// MaxRetries limits the number of consecutive failed reconnect attempts
+	// before ListenWithReconnect gives up. Zero means retry forever.
+	MaxRetries int
+
+	reconnectHandler func(*websocket.Conn)
+
+	// Codec controls how Send encodes outgoing values. It is not used for
+	// incoming frames: Listen always reads JSON, and ListenWithRouter
+	// decodes with the codec given to NewRouter. Defaults to JSONCodec{},
+	// matching the historical json.Marshal behaviour of Send.
+	Codec Codec
+
+	// Secure dials wss:// instead of ws:// when set.
+	Secure bool
+	// TLSConfig is passed to the dialer's TLS handshake. Only takes effect
+	// for wss:// connections (Secure set); ignored when Dialer is set.
+	TLSConfig *tls.Config
+	// Proxy selects the proxy URL for the connection request, mirroring
+	// http.Transport.Proxy. Defaults to http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+	// HandshakeTimeout bounds the initial WebSocket handshake.
+	HandshakeTimeout time.Duration
+	// Header carries additional request headers sent with the handshake,
+	// e.g. Authorization or Sec-WebSocket-Protocol.
+	Header http.Header
+	// Dialer, when set, is used as-is instead of building one from
+	// TLSConfig, Proxy and HandshakeTimeout. Secure still selects the scheme.
+	Dialer *websocket.Dialer
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	listenDone chan struct{}
+
+	// WriteQueueSize bounds how many Send payloads may queue up before
+	// ErrSendQueueFull is returned instead of blocking the caller. Defaults
+	// to 256 when zero.
+	WriteQueueSize int
+	// WriteWait bounds how long a single frame write may take before it is
+	// abandoned. Applied as a deadline before every write. Defaults to 10s
+	// when zero.
+	WriteWait time.Duration
+
+	sendChan       chan writingMessage
+	dropped        uint64
+	metricsHandler func(Metrics)
+}
+
+func (ws *WebsocketClient) dialer() *websocket.Dialer {
+	if ws.Dialer != nil {
+		return ws.Dialer
+	}
+	d := *websocket.DefaultDialer
+	if ws.TLSConfig != nil {
+		d.TLSClientConfig = ws.TLSConfig
+	}
+	if ws.Proxy != nil {
+		d.Proxy = ws.Proxy
+	}
+	if ws.HandshakeTimeout != 0 {
+		d.HandshakeTimeout = ws.HandshakeTimeout
+	}
+	return &d
+}
+
+func (ws *WebsocketClient) codec() Codec {
+	if ws.Codec == nil {
+		return JSONCodec{}
+	}
+	return ws.Codec
 }
 
 /*
@@ -42,56 +154,314 @@ func (ws *WebsocketClient) OnError(h func(interface{})) {
 }
 
 /*
-Connect - connecting to WS server
+OnReconnect - handler is called with the new connection every time
+ListenWithReconnect redials the server, so callers can replay subscription
+messages that the server forgot after the previous session dropped.
 */
-func (ws *WebsocketClient) Connect() error {
+func (ws *WebsocketClient) OnReconnect(h func(conn *websocket.Conn)) {
+	ws.reconnectHandler = h
+}
+
+/*
+OnMetrics - handler is called after every queued frame is written, and
+whenever Send drops a payload (with a WriteLatency of zero), with a
+snapshot of the send queue's depth, cumulative dropped-message count, and
+the latency of the last write, so operators can detect a queue stacking up under load before
+it causes an OOM.
+*/
+func (ws *WebsocketClient) OnMetrics(h func(Metrics)) {
+	ws.metricsHandler = h
+}
+
+/*
+Connect - connecting to WS server. ctx governs the connection's lifetime:
+cancelling it stops checkConnection and the writer goroutine and unblocks
+any in-flight Close/Shutdown. Use Shutdown for an orderly close instead of
+cancelling ctx directly.
+*/
+func (ws *WebsocketClient) Connect(ctx context.Context) error {
 
 	url := ws.getAddress()
 
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	c, _, err := ws.dialer().Dial(url, ws.Header)
 	if err != nil {
 		return err
 	}
+
+	if ws.cancel != nil {
+		// Stop the previous connection's writer goroutine before swapping
+		// in the new Conn/ctx/channels, so it never observes a half-swapped
+		// connection (ListenWithReconnect redials onto the same client).
+		ws.cancel()
+	}
+
 	ws.Conn = c // c is nil if error. Do not move above because of concurrent goroutines.
+	ws.ctx, ws.cancel = context.WithCancel(ctx)
+	ws.writeChan = make(chan writingMessage)
+	ws.writeErrChan = make(chan error)
 	ws.initData.Do(func() {
-		ws.writeChan = make(chan writingMessage)
-		ws.writeErrChan = make(chan error)
-		go func() {
-			for {
-				message := <-ws.writeChan
-				ws.writeErrChan <- ws.Conn.WriteMessage(message.messageType, message.data)
-			}
-		}()
+		queueSize := ws.WriteQueueSize
+		if queueSize <= 0 {
+			queueSize = defaultWriteQueueSize
+		}
+		ws.sendChan = make(chan writingMessage, queueSize)
 	})
+	go ws.writePump(c, ws.ctx, ws.writeChan, ws.writeErrChan)
 
 	return nil
 }
 
+func (ws *WebsocketClient) writeDeadline() time.Duration {
+	if ws.WriteWait <= 0 {
+		return defaultWriteWait
+	}
+	return ws.WriteWait
+}
+
+// writePump is the sole goroutine allowed to write to conn. Connect starts
+// a fresh writePump bound to its own conn/ctx/channels on every dial
+// (including reconnects), so the goroutine only ever touches the
+// connection it was handed and is never exposed to ws.Conn/ws.ctx being
+// reassigned by a concurrent redial. It services two sources: writeChan
+// carries control frames (ping, close) that block the caller until the
+// write completes; sendChan carries Send payloads queued by the caller,
+// written one frame per message so message boundaries always match what
+// ReadJSON/ReadMessage expects on the other side.
+func (ws *WebsocketClient) writePump(conn *websocket.Conn, ctx context.Context, writeChan <-chan writingMessage, writeErrChan chan<- error) {
+	defer close(writeErrChan)
+	for {
+		select {
+		case message, ok := <-writeChan:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(ws.writeDeadline()))
+			err := conn.WriteMessage(message.messageType, message.data)
+			// writeMessage's caller may already have abandoned the exchange
+			// via its own <-ctx.Done() arm, in which case nobody will ever
+			// receive on writeErrChan; select on ctx.Done() here too so this
+			// goroutine can't block forever delivering a result no one wants.
+			select {
+			case writeErrChan <- err:
+			case <-ctx.Done():
+				return
+			}
+		case message, ok := <-ws.sendChan:
+			if !ok {
+				return
+			}
+			ws.writeQueued(conn, message)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ws *WebsocketClient) writeQueued(conn *websocket.Conn, message writingMessage) {
+	start := time.Now()
+	conn.SetWriteDeadline(start.Add(ws.writeDeadline()))
+	err := conn.WriteMessage(message.messageType, message.data)
+	ws.reportMetrics(time.Since(start))
+	if err != nil {
+		go ws.handleError(err)
+	}
+}
+
+func (ws *WebsocketClient) reportMetrics(writeLatency time.Duration) {
+	if ws.metricsHandler == nil {
+		return
+	}
+	ws.metricsHandler(Metrics{
+		QueueDepth:      len(ws.sendChan),
+		DroppedMessages: atomic.LoadUint64(&ws.dropped),
+		WriteLatency:    writeLatency,
+	})
+}
+
+/*
+Listen — starting to listen to WS server. ctx bounds the read pump: once
+it is cancelled the connection is closed to unblock the pending read.
+*/
+func (ws *WebsocketClient) Listen(ctx context.Context) {
+	if ws.Conn == nil {
+		ws.Connect(ctx)
+	}
+	go ws.listen(ctx)
+}
+
+/*
+ListenWithReconnect - like Listen, but supervises the connection for its
+entire lifetime: whenever the read loop ends (connection loss, ping
+timeout, server close) it redials with exponential backoff and jitter,
+fires OnReconnect on the new connection, and resumes listening. It gives
+up once MaxRetries consecutive attempts fail, or immediately once ctx is
+cancelled. Intended for long-lived consumers (e.g. market-data feeds)
+that must survive network blips without the caller re-wiring
+subscriptions by hand.
+*/
+func (ws *WebsocketClient) ListenWithReconnect(ctx context.Context) {
+	go ws.superviseConnection(ctx)
+}
+
+func (ws *WebsocketClient) superviseConnection(ctx context.Context) {
+	backoff := ws.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	maxBackoff := ws.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	attempts := 0
+	for ctx.Err() == nil {
+		if err := ws.Connect(ctx); err != nil {
+			go ws.handleError(err)
+			attempts++
+			if ws.MaxRetries > 0 && attempts >= ws.MaxRetries {
+				return
+			}
+			if !sleepWithContext(ctx, nextBackoff(backoff)) {
+				return
+			}
+			backoff = growBackoff(backoff, maxBackoff)
+			continue
+		}
+
+		attempts = 0
+		backoff = ws.InitialBackoff
+		if backoff <= 0 {
+			backoff = defaultInitialBackoff
+		}
+		if ws.reconnectHandler != nil {
+			ws.reconnectHandler(ws.Conn)
+		}
+
+		ws.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The connection was established but then lost (auth failure after
+		// upgrade, idle kill, network blip) — back off before redialing so a
+		// server that drops us immediately doesn't turn this into a
+		// zero-delay hot reconnect loop.
+		attempts++
+		if ws.MaxRetries > 0 && attempts >= ws.MaxRetries {
+			return
+		}
+		if !sleepWithContext(ctx, nextBackoff(backoff)) {
+			return
+		}
+		backoff = growBackoff(backoff, maxBackoff)
+	}
+}
+
+// listen runs the read pump and the ping/pong supervisor on the current
+// connection and blocks until the connection is lost or ctx is cancelled.
+func (ws *WebsocketClient) listen(ctx context.Context) {
+	ws.listenDone = make(chan struct{})
+	defer close(ws.listenDone)
+
+	checkConnDone := make(chan struct{})
+	ws.Conn.SetPongHandler(func(string) error {
+		ws.Conn.SetReadDeadline(time.Time{})
+		return nil
+	})
+	go ws.checkConnection(checkConnDone)
+
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go ws.watchCancel(ctx, stopWatch)
+
+	defer close(checkConnDone)
+	defer ws.Conn.Close()
+	for {
+		var message interface{}
+		if err := ws.Conn.ReadJSON(&message); err != nil {
+			go ws.handleError(err)
+			return
+		}
+		go ws.handleData(message)
+	}
+}
+
 /*
-Listen — starting to listen to WS server
+ListenWithRouter - like Listen, but reads raw frames and dispatches each
+one through router instead of decoding into a generic interface{} and
+handing it to the OnData handler. A decode or dispatch error is passed to
+OnError; it does not end the read loop.
 */
-func (ws *WebsocketClient) Listen() {
+func (ws *WebsocketClient) ListenWithRouter(ctx context.Context, router *Router) {
 	if ws.Conn == nil {
-		ws.Connect()
+		ws.Connect(ctx)
 	}
+	go ws.listenWithRouter(ctx, router)
+}
+
+func (ws *WebsocketClient) listenWithRouter(ctx context.Context, router *Router) {
+	ws.listenDone = make(chan struct{})
+	defer close(ws.listenDone)
+
 	checkConnDone := make(chan struct{})
 	ws.Conn.SetPongHandler(func(string) error {
 		ws.Conn.SetReadDeadline(time.Time{})
 		return nil
 	})
 	go ws.checkConnection(checkConnDone)
-	go func(checkConnDone chan<- struct{}) {
-		defer close(checkConnDone)
-		defer ws.Conn.Close()
-		for {
-			var message interface{}
-			if err := ws.Conn.ReadJSON(&message); err != nil {
-				go ws.handleError(err)
-				return
-			}
-			go ws.handleData(message)
+
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go ws.watchCancel(ctx, stopWatch)
+
+	defer close(checkConnDone)
+	defer ws.Conn.Close()
+	for {
+		messageType, data, err := ws.Conn.ReadMessage()
+		if err != nil {
+			go ws.handleError(err)
+			return
+		}
+		if err := router.Dispatch(messageType, data); err != nil {
+			go ws.handleError(err)
 		}
-	}(checkConnDone)
+	}
+}
+
+// watchCancel closes the connection as soon as ctx is done, unblocking the
+// read pump's pending ReadJSON/ReadMessage call, unless stop fires first.
+func (ws *WebsocketClient) watchCancel(ctx context.Context, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		ws.Conn.Close()
+	case <-stop:
+	}
+}
+
+// nextBackoff applies jitter in the range [0.5*d, 1.5*d) so reconnecting
+// clients don't all retry in lockstep.
+func nextBackoff(d time.Duration) time.Duration {
+	jitter := time.Duration(rand.Int63n(int64(d))) - d/2
+	return d + jitter
+}
+
+func growBackoff(d, max time.Duration) time.Duration {
+	d *= 2
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 func (ws *WebsocketClient) checkConnection(done <-chan struct{}) {
@@ -117,9 +487,17 @@ func (ws *WebsocketClient) checkConnection(done <-chan struct{}) {
 }
 
 func (ws *WebsocketClient) writeMessage(messageType int, data []byte) error {
-	ws.writeChan <- writingMessage{messageType: messageType, data: data}
-	err := <-ws.writeErrChan
-	return err
+	select {
+	case ws.writeChan <- writingMessage{messageType: messageType, data: data}:
+	case <-ws.ctx.Done():
+		return ws.ctx.Err()
+	}
+	select {
+	case err := <-ws.writeErrChan:
+		return err
+	case <-ws.ctx.Done():
+		return ws.ctx.Err()
+	}
 }
 
 func (ws *WebsocketClient) handleData(data interface{}) {
@@ -135,29 +513,75 @@ func (ws *WebsocketClient) handleError(err interface{}) {
 }
 
 /*
-Send - sending action to WS server. May return error
+Send - sending action to WS server. Encodes data with ws.Codec (JSONCodec
+by default) and queues it on the bounded send pipeline; it never blocks on
+the network. Returns ErrSendQueueFull immediately if WriteQueueSize
+payloads are already pending, so a slow consumer can't stall the caller or
+deadlock with the reader.
 */
 func (ws *WebsocketClient) Send(data interface{}) error {
-	req, err := json.Marshal(data)
+	req, messageType, err := ws.codec().Encode(data)
 	if err != nil {
 		return err
 	}
-	return ws.writeMessage(websocket.TextMessage, req)
+	select {
+	case ws.sendChan <- writingMessage{messageType: messageType, data: req}:
+		return nil
+	default:
+		atomic.AddUint64(&ws.dropped, 1)
+		ws.reportMetrics(0)
+		return ErrSendQueueFull
+	}
 }
 
 func (ws *WebsocketClient) getAddress() string {
-	return "ws://" + ws.Host.Host + ":" + strconv.Itoa(ws.Host.Port) + ws.Host.Path
+	scheme := "ws://"
+	if ws.Secure {
+		scheme = "wss://"
+	}
+	return scheme + ws.Host.Host + ":" + strconv.Itoa(ws.Host.Port) + ws.Host.Path
 }
 
 /*
-Close - closing connection
+Shutdown - gracefully closes the connection: sends a close frame, waits up
+to timeout for the peer's close frame to surface on the read pump (so
+trailing frames already in flight aren't dropped), then cancels the
+client's context to stop checkConnection and unblock any in-flight
+writeMessage call. writeChan is never closed: writePump already exits
+cleanly via its own <-ctx.Done() case, so there is no close for a
+concurrent writeMessage send to race against. writeErrChan is closed only
+by writePump itself as it exits. Safe to call more than once; ctx.Err() just comes back
+already-cancelled on later calls.
 */
-func (ws *WebsocketClient) Close() error {
-	if ws.Conn != nil {
-		return ws.writeMessage(
-			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-		)
+func (ws *WebsocketClient) Shutdown(timeout time.Duration) error {
+	if ws.Conn == nil {
+		return nil
 	}
-	return nil
+
+	closeErr := ws.writeMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+	)
+
+	if ws.listenDone != nil {
+		select {
+		case <-ws.listenDone:
+		case <-time.After(timeout):
+		}
+	}
+
+	if ws.cancel != nil {
+		ws.cancel()
+	}
+
+	return closeErr
+}
+
+/*
+Close - closing connection. Equivalent to Shutdown with a short default
+grace period; prefer Shutdown when callers need control over how long to
+wait for the peer's close frame.
+*/
+func (ws *WebsocketClient) Close() error {
+	return ws.Shutdown(5 * time.Second)
 }
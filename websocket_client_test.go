@@ -0,0 +1,136 @@
+package middlewares
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testServerHost(t *testing.T, srv *httptest.Server) (host string, port int) {
+	t.Helper()
+	h, p, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("split test server address: %v", err)
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil {
+		t.Fatalf("parse test server port: %v", err)
+	}
+	return h, port
+}
+
+// TestSendReturnsErrSendQueueFullWhenSaturated exercises the backpressure
+// path directly against sendChan, without dialing a real connection: Send
+// only ever touches ws.sendChan, never the network.
+func TestSendReturnsErrSendQueueFullWhenSaturated(t *testing.T) {
+	ws := &WebsocketClient{}
+	ws.ctx, ws.cancel = context.WithCancel(context.Background())
+	defer ws.cancel()
+	ws.sendChan = make(chan writingMessage, 1)
+
+	var reports []Metrics
+	ws.OnMetrics(func(m Metrics) { reports = append(reports, m) })
+
+	if err := ws.Send(map[string]int{"a": 1}); err != nil {
+		t.Fatalf("first send: unexpected error: %v", err)
+	}
+	if err := ws.Send(map[string]int{"a": 2}); err != ErrSendQueueFull {
+		t.Fatalf("second send: got %v, want ErrSendQueueFull", err)
+	}
+
+	if len(reports) != 1 || reports[0].DroppedMessages != 1 {
+		t.Fatalf("expected one dropped-message metrics report, got %+v", reports)
+	}
+}
+
+// TestShutdownDoesNotRaceWithActivePings is a regression test for the
+// writeChan close that used to race writeMessage under Shutdown: it fires
+// pings concurrently with Shutdown against a real connection and expects
+// no panic.
+func TestShutdownDoesNotRaceWithActivePings(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ws := &WebsocketClient{}
+	ws.Host.Host, ws.Host.Port = testServerHost(t, srv)
+	ws.Host.Path = "/"
+
+	if err := ws.Connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	ws.Listen(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ws.writeMessage(websocket.PingMessage, []byte("PING"))
+		}
+	}()
+
+	if err := ws.Shutdown(time.Second); err != nil {
+		t.Logf("shutdown returned %v (a cancelled/closed error here is fine)", err)
+	}
+	wg.Wait()
+}
+
+// TestListenWithReconnectBacksOffAfterEstablishedConnectionDrops guards
+// against the hot reconnect loop that used to follow an established
+// connection being dropped by the server: it expects far fewer reconnect
+// attempts than a zero-delay loop would produce in the same window.
+func TestListenWithReconnectBacksOffAfterEstablishedConnectionDrops(t *testing.T) {
+	var attempts int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close() // drop immediately after the handshake completes
+	}))
+	defer srv.Close()
+
+	ws := &WebsocketClient{
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+	ws.Host.Host, ws.Host.Port = testServerHost(t, srv)
+	ws.Host.Path = "/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ws.ListenWithReconnect(ctx)
+
+	time.Sleep(250 * time.Millisecond)
+
+	got := atomic.LoadInt32(&attempts)
+	if got == 0 {
+		t.Fatal("expected at least one connection attempt")
+	}
+	if got > 20 {
+		t.Fatalf("reconnected %d times in 250ms; backoff does not appear to be applied", got)
+	}
+}
@@ -0,0 +1,149 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+Codec - encodes outgoing values and decodes incoming frames for a
+WebsocketClient. Built-in implementations are JSONCodec (the default,
+matching the package's historical behaviour), MessagePackCodec and
+RawCodec.
+*/
+type Codec interface {
+	Encode(v interface{}) (data []byte, messageType int, err error)
+	Decode(messageType int, data []byte, v interface{}) error
+}
+
+/*
+JSONCodec - marshals/unmarshals values as JSON text frames.
+*/
+type JSONCodec struct{}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(v interface{}) ([]byte, int, error) {
+	data, err := json.Marshal(v)
+	return data, websocket.TextMessage, err
+}
+
+// Decode implements Codec.
+func (JSONCodec) Decode(_ int, data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+/*
+MessagePackCodec - marshals/unmarshals values as MessagePack binary
+frames.
+*/
+type MessagePackCodec struct{}
+
+// Encode implements Codec.
+func (MessagePackCodec) Encode(v interface{}) ([]byte, int, error) {
+	data, err := msgpack.Marshal(v)
+	return data, websocket.BinaryMessage, err
+}
+
+// Decode implements Codec.
+func (MessagePackCodec) Decode(_ int, data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+/*
+RawCodec - passes []byte payloads through unchanged as binary frames.
+Encode expects a []byte value; Decode expects v to be a *[]byte.
+*/
+type RawCodec struct{}
+
+// Encode implements Codec.
+func (RawCodec) Encode(v interface{}) ([]byte, int, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, 0, fmt.Errorf("middlewares: RawCodec.Encode expects []byte, got %T", v)
+	}
+	return data, websocket.BinaryMessage, nil
+}
+
+// Decode implements Codec.
+func (RawCodec) Decode(_ int, data []byte, v interface{}) error {
+	out, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("middlewares: RawCodec.Decode expects *[]byte, got %T", v)
+	}
+	*out = data
+	return nil
+}
+
+/*
+Router - dispatches decoded frames to typed handlers keyed by a
+discriminator field (e.g. {"type":"trade", ...}), so callers get
+router.OnMessage("trade", func(m TradeMsg){...}) ergonomics instead of
+type-asserting a generic map out of dataHandler(interface{}).
+*/
+type Router struct {
+	field    string
+	codec    Codec
+	handlers map[string]reflect.Value
+	types    map[string]reflect.Type
+}
+
+/*
+NewRouter - creates a Router that reads discriminatorField out of each
+frame to pick the registered handler. codec decodes the frame into the
+handler's concrete message type; it defaults to JSONCodec{} when nil.
+*/
+func NewRouter(discriminatorField string, codec Codec) *Router {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Router{
+		field:    discriminatorField,
+		codec:    codec,
+		handlers: make(map[string]reflect.Value),
+		types:    make(map[string]reflect.Type),
+	}
+}
+
+/*
+OnMessage - registers handler for frames whose discriminator field equals
+kind. handler must be a func(T) for some concrete message type T; the
+router allocates a fresh *T via reflection and decodes each matching
+frame into it before calling handler.
+*/
+func (r *Router) OnMessage(kind string, handler interface{}) error {
+	hv := reflect.ValueOf(handler)
+	ht := hv.Type()
+	if ht.Kind() != reflect.Func || ht.NumIn() != 1 {
+		return fmt.Errorf("middlewares: OnMessage handler must be func(T), got %T", handler)
+	}
+	r.handlers[kind] = hv
+	r.types[kind] = ht.In(0)
+	return nil
+}
+
+/*
+Dispatch - decodes a raw frame, determines its kind via the discriminator
+field and invokes the matching handler registered with OnMessage.
+*/
+func (r *Router) Dispatch(messageType int, data []byte) error {
+	var peek map[string]interface{}
+	if err := r.codec.Decode(messageType, data, &peek); err != nil {
+		return err
+	}
+	kind, _ := peek[r.field].(string)
+	handler, ok := r.handlers[kind]
+	if !ok {
+		return fmt.Errorf("middlewares: no handler registered for %q=%q", r.field, kind)
+	}
+
+	msgPtr := reflect.New(r.types[kind])
+	if err := r.codec.Decode(messageType, data, msgPtr.Interface()); err != nil {
+		return err
+	}
+	handler.Call([]reflect.Value{msgPtr.Elem()})
+	return nil
+}
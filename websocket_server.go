@@ -0,0 +1,255 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	serverWriteWait  = 10 * time.Second
+	serverPongWait   = 60 * time.Second
+	serverPingPeriod = (serverPongWait * 9) / 10
+	serverMaxMessage = 512 * 1024
+)
+
+/*
+Authorize - validates an incoming upgrade request and returns the
+authenticated user ID. Returning ok == false rejects the upgrade with
+http.StatusUnauthorized.
+*/
+type Authorize func(r *http.Request) (userID string, ok bool)
+
+/*
+Client - a single registered server-side WebSocket connection. Reads are
+pumped by readPump and writes are serialized through send to writePump,
+so the underlying gorilla connection has at most one reader and one
+writer at a time.
+*/
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte
+	userID string
+	topics map[string]struct{}
+	mu     sync.Mutex
+}
+
+/*
+Hub - tracks registered clients and fans messages out to them. All
+mutations of the client set happen on the single goroutine started by
+Run, so register/unregister/broadcast never race with each other.
+*/
+type Hub struct {
+	upgrader       websocket.Upgrader
+	authorize      Authorize
+	dataHandler    func(userID string, data interface{})
+	connectHandler func(*Client)
+
+	clients    map[*Client]struct{}
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan hubMessage
+}
+
+type hubMessage struct {
+	topic   string
+	payload []byte
+}
+
+/*
+NewHub - creates a Hub ready to be started with Run. Authorize may be nil,
+in which case every upgrade request is accepted with an empty userID.
+*/
+func NewHub(authorize Authorize) *Hub {
+	return &Hub{
+		upgrader:   websocket.Upgrader{},
+		authorize:  authorize,
+		clients:    make(map[*Client]struct{}),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan hubMessage),
+	}
+}
+
+/*
+OnData - handler will handle incoming data sent by any connected client.
+*/
+func (h *Hub) OnData(handler func(userID string, data interface{})) {
+	h.dataHandler = handler
+}
+
+/*
+OnConnect - handler is called with the *Client as soon as it is registered
+with the hub, so callers can stash a reference (e.g. keyed by userID) and
+later call Subscribe on it. Without this hook there is no way to obtain a
+*Client from outside ServeHTTP, which makes topic subscriptions
+unreachable.
+*/
+func (h *Hub) OnConnect(handler func(*Client)) {
+	h.connectHandler = handler
+}
+
+/*
+Run - drives the hub's register/unregister/broadcast loop. Blocks until
+done is closed, so callers typically invoke it with go hub.Run(done).
+*/
+func (h *Hub) Run(done <-chan struct{}) {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = struct{}{}
+		case c := <-h.unregister:
+			if _, ok := h.clients[c]; ok {
+				delete(h.clients, c)
+				close(c.send)
+			}
+		case msg := <-h.broadcast:
+			for c := range h.clients {
+				if msg.topic != "" {
+					c.mu.Lock()
+					_, subscribed := c.topics[msg.topic]
+					c.mu.Unlock()
+					if !subscribed {
+						continue
+					}
+				}
+				select {
+				case c.send <- msg.payload:
+				default:
+					// slow consumer: drop it instead of blocking the hub
+					delete(h.clients, c)
+					close(c.send)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+/*
+Broadcast - sends payload to every client subscribed to topic. An empty
+topic broadcasts to all connected clients.
+*/
+func (h *Hub) Broadcast(topic string, payload []byte) {
+	h.broadcast <- hubMessage{topic: topic, payload: payload}
+}
+
+/*
+Subscribe - adds topic to the set of topics client receives broadcasts
+for.
+*/
+func (h *Hub) Subscribe(client *Client, topic string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.topics == nil {
+		client.topics = make(map[string]struct{})
+	}
+	client.topics[topic] = struct{}{}
+}
+
+/*
+WebsocketServer - upgrades incoming HTTP requests to WebSocket connections
+and registers them with a Hub.
+*/
+type WebsocketServer struct {
+	Hub *Hub
+}
+
+/*
+NewWebsocketServer - creates a WebsocketServer backed by hub. Callers must
+start hub.Run in their own goroutine before serving requests.
+*/
+func NewWebsocketServer(hub *Hub) *WebsocketServer {
+	return &WebsocketServer{Hub: hub}
+}
+
+/*
+ServeHTTP - implements http.Handler, upgrading the request to a WebSocket
+connection and handing it off to the hub.
+*/
+func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userID := ""
+	if s.Hub.authorize != nil {
+		id, ok := s.Hub.authorize(r)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		userID = id
+	}
+
+	conn, err := s.Hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	client := &Client{
+		hub:    s.Hub,
+		conn:   conn,
+		send:   make(chan []byte, 256),
+		userID: userID,
+	}
+	s.Hub.register <- client
+	if s.Hub.connectHandler != nil {
+		s.Hub.connectHandler(client)
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(serverMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(serverPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(serverPongWait))
+		return nil
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if c.hub.dataHandler != nil {
+			var message interface{}
+			if err := json.Unmarshal(data, &message); err == nil {
+				c.hub.dataHandler(c.userID, message)
+			}
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(serverPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(serverWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(serverWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
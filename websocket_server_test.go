@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHubBroadcastOnlyReachesSubscribedClients(t *testing.T) {
+	hub := NewHub(nil)
+	done := make(chan struct{})
+	go hub.Run(done)
+	defer close(done)
+
+	subscribed := &Client{hub: hub, send: make(chan []byte, 1)}
+	other := &Client{hub: hub, send: make(chan []byte, 1)}
+
+	hub.register <- subscribed
+	hub.register <- other
+	hub.Subscribe(subscribed, "trades")
+
+	hub.Broadcast("trades", []byte("tick"))
+
+	select {
+	case payload := <-subscribed.send:
+		if string(payload) != "tick" {
+			t.Fatalf("unexpected payload: %s", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscribed client never received the topic broadcast")
+	}
+
+	select {
+	case payload := <-other.send:
+		t.Fatalf("non-subscribed client received the topic broadcast: %s", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}